@@ -0,0 +1,238 @@
+/*
+ * Copyright 2025 The Kythe Authors. All rights reserved.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *   http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+
+	"kythe.io/kythe/go/platform/vfs"
+	apb "kythe.io/kythe/proto/analysis_go_proto"
+)
+
+// DiscoveryMode selects how a crate's source files are found.
+type DiscoveryMode string
+
+const (
+	// DiscoveryRustProject walks Source.IncludeDirs/ExcludeDirs from
+	// rust-project.json, this tool's original behavior.
+	DiscoveryRustProject DiscoveryMode = "rust-project"
+	// DiscoveryCargoMetadata asks `cargo metadata`/`cargo package --list`
+	// which files belong to a crate, the way `cargo publish` would see it.
+	// This is more precise than walking include/exclude dirs, but it costs
+	// one `cargo package --list` subprocess per crate (see
+	// getSourceFilesFromCargoMetadata): on a Fuchsia-sized tree with
+	// thousands of crates, that reintroduces the per-crate overhead
+	// buildCompilationUnitsParallel's worker pool was written to amortize,
+	// just moved from file-walking into process spawning. Fine for now;
+	// worth batching or caching across crates sharing a package if it shows
+	// up as a bottleneck in practice.
+	DiscoveryCargoMetadata DiscoveryMode = "cargo-metadata"
+	// DiscoveryHybrid prefers cargo-metadata, falling back to the
+	// rust-project.json include dirs for crates cargo metadata can't find
+	// (e.g. sysroot crates, which have no Cargo.toml).
+	DiscoveryHybrid DiscoveryMode = "hybrid"
+)
+
+// cargoPackage is the subset of `cargo metadata`'s per-package output this
+// tool needs to locate a package's manifest on disk.
+type cargoPackage struct {
+	Name         string `json:"name"`
+	Version      string `json:"version"`
+	ManifestPath string `json:"manifest_path"`
+}
+
+// cargoMetadata is the subset of `cargo metadata --format-version=1`'s
+// top-level output this tool consumes.
+type cargoMetadata struct {
+	Packages []cargoPackage `json:"packages"`
+}
+
+// loadCargoMetadata runs `cargo metadata` against the Cargo.toml workspace
+// rooted at workspaceDir and parses its packages.
+func loadCargoMetadata(ctx context.Context, workspaceDir string) (*cargoMetadata, error) {
+	manifestPath := filepath.Join(workspaceDir, "Cargo.toml")
+	cmd := exec.CommandContext(ctx, "cargo", "metadata", "--format-version=1", "--no-deps", "--manifest-path", manifestPath)
+	var stderr bytes.Buffer
+	cmd.Stderr = &stderr
+	out, err := cmd.Output()
+	if err != nil {
+		return nil, fmt.Errorf("cargo metadata --manifest-path %s: %w: %s", manifestPath, err, stderr.String())
+	}
+	var meta cargoMetadata
+	if err := json.Unmarshal(out, &meta); err != nil {
+		return nil, fmt.Errorf("parsing cargo metadata output: %w", err)
+	}
+	return &meta, nil
+}
+
+// findCargoPackage locates the cargo-metadata package backing crate, if
+// any. Crates are matched by crateName(crate) (display name, falling back
+// to crate.Label's final path component the same way rustc-argument
+// construction does) since rust-project.json crate ids have no direct
+// cargo-metadata analog. It is an error, not a guess, for more than one
+// package to match when crate.Version doesn't disambiguate them -- e.g. a
+// diamond dependency pulling in two versions of the same crate.
+func (meta *cargoMetadata) findCargoPackage(crate Crate) (*cargoPackage, error) {
+	name := crateName(crate)
+	var matches []*cargoPackage
+	for i, pkg := range meta.Packages {
+		if pkg.Name != name {
+			continue
+		}
+		if crate.Version != "" && crate.Version != pkg.Version {
+			continue
+		}
+		matches = append(matches, &meta.Packages[i])
+	}
+	switch len(matches) {
+	case 0:
+		return nil, nil
+	case 1:
+		return matches[0], nil
+	default:
+		return nil, fmt.Errorf("ambiguous cargo-metadata match for crate %s: %d packages named %q and crate.Version is empty, so they can't be disambiguated", crate.Label, len(matches), name)
+	}
+}
+
+// cargoPackageFiles runs `cargo package --list` for the package rooted at
+// manifestPath, which reports the exact set of files `cargo publish` would
+// ship -- i.e. include/exclude globs, .gitignore, and .cargo_vcs_info
+// already applied -- as paths relative to the package root. Called once per
+// crate (see DiscoveryCargoMetadata's doc comment for the subprocess-count
+// tradeoff that implies).
+func cargoPackageFiles(ctx context.Context, manifestPath string) ([]string, error) {
+	cmd := exec.CommandContext(ctx, "cargo", "package", "--list", "--allow-dirty", "--quiet", "--manifest-path", manifestPath)
+	var stderr bytes.Buffer
+	cmd.Stderr = &stderr
+	out, err := cmd.Output()
+	if err != nil {
+		return nil, fmt.Errorf("cargo package --list --manifest-path %s: %w: %s", manifestPath, err, stderr.String())
+	}
+	var files []string
+	for _, line := range strings.Split(strings.TrimRight(string(out), "\n"), "\n") {
+		if line == "" {
+			continue
+		}
+		files = append(files, line)
+	}
+	return files, nil
+}
+
+// getSourceFilesFromCargoMetadata appends to required_inputs the .rs files
+// `cargo package --list` reports for crate's package, plus any .rs files
+// under its build script's OUT_DIR (see addGeneratedOutDirFiles), digesting
+// and adding each to the kzip archive through cache. It reports ok=false (with a nil error) when crate has
+// no corresponding cargo-metadata package, so callers running in hybrid
+// mode can fall back to the rust-project.json include dirs instead.
+func getSourceFilesFromCargoMetadata(ctx context.Context, crate Crate, meta *cargoMetadata, projectRoot string, required_inputs *[]*apb.CompilationUnit_FileInput, cache *digestCache, mapper *VNameMapper) (sourceFiles []string, ok bool, err error) {
+	pkg, err := meta.findCargoPackage(crate)
+	if err != nil {
+		return nil, true, err
+	}
+	if pkg == nil {
+		return nil, false, nil
+	}
+	pkgDir := filepath.Dir(pkg.ManifestPath)
+
+	relFiles, err := cargoPackageFiles(ctx, pkg.ManifestPath)
+	if err != nil {
+		return nil, true, err
+	}
+
+	for _, relFile := range relFiles {
+		if filepath.Ext(relFile) != ".rs" {
+			continue
+		}
+		absPath := filepath.Join(pkgDir, relFile)
+
+		digest, err := cache.digestFile(ctx, absPath)
+		if err != nil {
+			return nil, true, err
+		}
+
+		path := removeProjectRoot(absPath, projectRoot)
+		sourceFiles = append(sourceFiles, path)
+		*required_inputs = append(*required_inputs, &apb.CompilationUnit_FileInput{
+			VName: mapper.Map(path, crate),
+			Info: &apb.FileInfo{
+				Path:   path,
+				Digest: digest,
+			},
+		})
+	}
+
+	generated, err := addGeneratedOutDirFiles(ctx, crate, projectRoot, required_inputs, cache, mapper)
+	if err != nil {
+		return nil, true, err
+	}
+	sourceFiles = append(sourceFiles, generated...)
+
+	return sourceFiles, true, nil
+}
+
+// addGeneratedOutDirFiles walks crate.Build.OutDir (a build script's
+// output directory) for .rs files it generated and adds them as required
+// inputs, returning the paths it added. cargo package --list can't see
+// these: they don't exist until the build script actually runs, well after
+// `cargo package` enumerates what ships in the crate's source archive. If
+// OutDir is unset or doesn't exist yet (e.g. the build script hasn't run),
+// this is a no-op rather than an error.
+func addGeneratedOutDirFiles(ctx context.Context, crate Crate, projectRoot string, required_inputs *[]*apb.CompilationUnit_FileInput, cache *digestCache, mapper *VNameMapper) ([]string, error) {
+	if crate.Build == nil || crate.Build.OutDir == "" {
+		return nil, nil
+	}
+	if _, err := os.Stat(crate.Build.OutDir); err != nil {
+		return nil, nil
+	}
+
+	var generated []string
+	err := vfs.Walk(ctx, crate.Build.OutDir, func(absPath string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		if info.IsDir() || filepath.Ext(absPath) != ".rs" {
+			return nil
+		}
+
+		digest, err := cache.digestFile(ctx, absPath)
+		if err != nil {
+			return err
+		}
+
+		path := removeProjectRoot(absPath, projectRoot)
+		generated = append(generated, path)
+		*required_inputs = append(*required_inputs, &apb.CompilationUnit_FileInput{
+			VName: mapper.Map(path, crate),
+			Info: &apb.FileInfo{
+				Path:   path,
+				Digest: digest,
+			},
+		})
+		return nil
+	})
+	if err != nil {
+		return nil, fmt.Errorf("walking build.rs OUT_DIR %s for crate %s: %w", crate.Build.OutDir, crate.Label, err)
+	}
+	return generated, nil
+}
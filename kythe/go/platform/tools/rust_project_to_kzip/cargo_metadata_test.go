@@ -0,0 +1,85 @@
+/*
+ * Copyright 2025 The Kythe Authors. All rights reserved.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *   http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package main
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestFindCargoPackageMatchesByCrateName(t *testing.T) {
+	meta := &cargoMetadata{Packages: []cargoPackage{
+		{Name: "serde", Version: "1.2.3", ManifestPath: "/vendor/serde-1.2.3/Cargo.toml"},
+	}}
+
+	// No display_name: rust-project.json labels are Bazel/Buck targets, not
+	// cargo-metadata package names, so matching must go through crateName's
+	// filepath.Base(Label) fallback, not the raw Label.
+	crate := Crate{Label: "third_party/rust_crates/serde"}
+	pkg, err := meta.findCargoPackage(crate)
+	if err != nil {
+		t.Fatalf("findCargoPackage() = %v, want nil error", err)
+	}
+	if pkg == nil || pkg.ManifestPath != "/vendor/serde-1.2.3/Cargo.toml" {
+		t.Errorf("findCargoPackage() = %+v, want the serde package", pkg)
+	}
+}
+
+func TestFindCargoPackageNoMatch(t *testing.T) {
+	meta := &cargoMetadata{Packages: []cargoPackage{{Name: "serde", Version: "1.2.3"}}}
+	pkg, err := meta.findCargoPackage(Crate{Label: "//third_party/rust_crates:rand-0.8"})
+	if err != nil {
+		t.Fatalf("findCargoPackage() = %v, want nil error", err)
+	}
+	if pkg != nil {
+		t.Errorf("findCargoPackage() = %+v, want nil", pkg)
+	}
+}
+
+func TestFindCargoPackageVersionDisambiguates(t *testing.T) {
+	meta := &cargoMetadata{Packages: []cargoPackage{
+		{Name: "serde", Version: "1.0.0", ManifestPath: "/vendor/serde-1.0.0/Cargo.toml"},
+		{Name: "serde", Version: "1.2.3", ManifestPath: "/vendor/serde-1.2.3/Cargo.toml"},
+	}}
+
+	pkg, err := meta.findCargoPackage(Crate{Label: "x/serde", Version: "1.2.3"})
+	if err != nil {
+		t.Fatalf("findCargoPackage() = %v, want nil error", err)
+	}
+	if pkg == nil || pkg.ManifestPath != "/vendor/serde-1.2.3/Cargo.toml" {
+		t.Errorf("findCargoPackage() = %+v, want the 1.2.3 package", pkg)
+	}
+}
+
+func TestFindCargoPackageAmbiguousWithoutVersionIsAnError(t *testing.T) {
+	// A diamond dependency: two versions of the same crate in the
+	// workspace, and rust-project.json didn't tell us which one this crate
+	// id refers to. Guessing the first match would silently bind the wrong
+	// files; this must be reported instead.
+	meta := &cargoMetadata{Packages: []cargoPackage{
+		{Name: "serde", Version: "1.0.0", ManifestPath: "/vendor/serde-1.0.0/Cargo.toml"},
+		{Name: "serde", Version: "1.2.3", ManifestPath: "/vendor/serde-1.2.3/Cargo.toml"},
+	}}
+
+	pkg, err := meta.findCargoPackage(Crate{Label: "x/serde"})
+	if err == nil {
+		t.Fatalf("findCargoPackage() = (%+v, nil), want an ambiguous-match error", pkg)
+	}
+	if !strings.Contains(err.Error(), "ambiguous") {
+		t.Errorf("findCargoPackage() error = %q, want it to mention the match is ambiguous", err)
+	}
+}
@@ -0,0 +1,75 @@
+/*
+ * Copyright 2025 The Kythe Authors. All rights reserved.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *   http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package main
+
+import (
+	"encoding/json"
+	"testing"
+)
+
+func TestCfgFlagUnmarshalJSON(t *testing.T) {
+	tests := []struct {
+		name      string
+		raw       string
+		wantKey   string
+		wantValue string
+		wantHas   bool
+	}{
+		{name: "atom", raw: `"unix"`, wantKey: "unix"},
+		{name: "quoted value", raw: `"feature=\"foo\""`, wantKey: "feature", wantValue: "foo", wantHas: true},
+		{name: "unquoted value", raw: `"target_arch=x86_64"`, wantKey: "target_arch", wantValue: "x86_64", wantHas: true},
+		{name: "empty quoted value", raw: `"feature=\"\""`, wantKey: "feature", wantValue: "", wantHas: true},
+		{name: "value containing equals", raw: `"key=\"a=b\""`, wantKey: "key", wantValue: "a=b", wantHas: true},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			var cfg CfgFlag
+			if err := json.Unmarshal([]byte(test.raw), &cfg); err != nil {
+				t.Fatalf("Unmarshal(%s) = %v, want nil error", test.raw, err)
+			}
+			if cfg.Key != test.wantKey || cfg.Value != test.wantValue || cfg.HasValue() != test.wantHas {
+				t.Errorf("Unmarshal(%s) = {Key: %q, Value: %q, HasValue: %v}, want {Key: %q, Value: %q, HasValue: %v}",
+					test.raw, cfg.Key, cfg.Value, cfg.HasValue(), test.wantKey, test.wantValue, test.wantHas)
+			}
+		})
+	}
+}
+
+func TestCfgFlagUnmarshalJSONRejectsNonString(t *testing.T) {
+	var cfg CfgFlag
+	if err := json.Unmarshal([]byte(`42`), &cfg); err == nil {
+		t.Error("Unmarshal(42) = nil error, want an error")
+	}
+}
+
+func TestCfgFlagString(t *testing.T) {
+	tests := []struct {
+		name string
+		cfg  CfgFlag
+		want string
+	}{
+		{name: "atom", cfg: CfgFlag{Key: "unix"}, want: "unix"},
+		{name: "key value", cfg: CfgFlag{Key: "feature", Value: "foo", hasValue: true}, want: `feature="foo"`},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			if got := test.cfg.String(); got != test.want {
+				t.Errorf("String() = %q, want %q", got, test.want)
+			}
+		})
+	}
+}
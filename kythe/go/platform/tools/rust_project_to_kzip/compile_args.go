@@ -0,0 +1,103 @@
+/*
+ * Copyright 2025 The Kythe Authors. All rights reserved.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *   http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package main
+
+import (
+	"fmt"
+	"path/filepath"
+	"sort"
+
+	"google.golang.org/protobuf/types/known/anypb"
+
+	rdpb "kythe.io/kythe/proto/rust_details_go_proto"
+)
+
+// crateName returns the name rustc would be invoked with for crate:
+// DisplayName if rust-project.json provided one, else the final path
+// component of its Label (rust-project.json labels are Bazel/Buck-style
+// targets like "//src/foo:bar").
+func crateName(crate Crate) string {
+	if crate.DisplayName != "" {
+		return crate.DisplayName
+	}
+	return filepath.Base(crate.Label)
+}
+
+// buildRustcArguments reconstructs the rustc-equivalent command line for
+// crate, so a downstream Rust indexer can tell exactly which cfg-gated
+// code paths were active without re-deriving them from CompilerArgs alone.
+// crateByID resolves a Dep's CrateId to the dependency's Crate so its
+// RootModule can stand in for the compiled artifact path in --extern; this
+// tool indexes source rather than compiling, so there is no real .rlib to
+// point at.
+func buildRustcArguments(crate Crate, crateByID map[uint32]Crate) []string {
+	var args []string
+
+	if crate.Edition != "" {
+		args = append(args, "--edition", crate.Edition)
+	}
+	args = append(args, "--crate-name", crateName(crate))
+	if crate.CrateType != "" {
+		args = append(args, "--crate-type", crate.CrateType)
+	}
+
+	for _, cfg := range crate.Cfg {
+		args = append(args, "--cfg", cfg.String())
+	}
+
+	depDirs := make(map[string]bool)
+	for _, dep := range crate.Deps {
+		if depCrate, ok := crateByID[dep.CrateId]; ok {
+			depDirs[filepath.Dir(depCrate.RootModule)] = true
+		}
+	}
+	var sortedDirs []string
+	for dir := range depDirs {
+		sortedDirs = append(sortedDirs, dir)
+	}
+	sort.Strings(sortedDirs)
+	for _, dir := range sortedDirs {
+		args = append(args, "-L", dir)
+	}
+
+	for _, dep := range crate.Deps {
+		depCrate, ok := crateByID[dep.CrateId]
+		if !ok {
+			continue
+		}
+		args = append(args, "--extern", fmt.Sprintf("%s=%s", dep.Name, depCrate.RootModule))
+	}
+
+	args = append(args, crate.CompilerArgs...)
+	return args
+}
+
+// buildRustCompilationDetails packs the rust-project.json facts that don't
+// fit CompilationUnit's generic fields into a RustCompilationDetails Any,
+// suitable for appending to CompilationUnit.Details.
+func buildRustCompilationDetails(crate Crate, transitiveDeps []uint32) (*anypb.Any, error) {
+	sortedDeps := append([]uint32(nil), transitiveDeps...)
+	sort.Slice(sortedDeps, func(i, j int) bool { return sortedDeps[i] < sortedDeps[j] })
+
+	details := &rdpb.RustCompilationDetails{
+		Edition:               crate.Edition,
+		CrateId:               crate.CrateId,
+		Target:                crate.Target,
+		TransitiveDepCrateIds: sortedDeps,
+	}
+	return anypb.New(details)
+}
@@ -0,0 +1,114 @@
+/*
+ * Copyright 2025 The Kythe Authors. All rights reserved.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *   http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package main
+
+import (
+	"reflect"
+	"testing"
+
+	rdpb "kythe.io/kythe/proto/rust_details_go_proto"
+)
+
+func TestCrateName(t *testing.T) {
+	tests := []struct {
+		name  string
+		crate Crate
+		want  string
+	}{
+		{name: "display name wins", crate: Crate{DisplayName: "serde", Label: "third_party/rust_crates/serde-1.2.3"}, want: "serde"},
+		{name: "falls back to label's final path component", crate: Crate{Label: "third_party/rust_crates/serde-1.2.3"}, want: "serde-1.2.3"},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			if got := crateName(test.crate); got != test.want {
+				t.Errorf("crateName(%+v) = %q, want %q", test.crate, got, test.want)
+			}
+		})
+	}
+}
+
+func TestBuildRustcArguments(t *testing.T) {
+	crateByID := map[uint32]Crate{
+		1: {CrateId: 1, RootModule: "/root/b_dep/lib.rs"},
+		2: {CrateId: 2, RootModule: "/root/a_dep/lib.rs"},
+		3: {CrateId: 3, RootModule: "/root/a_dep/other.rs"}, // shares a -L dir with crate 2
+	}
+	crate := Crate{
+		Edition:   "2021",
+		Label:     "src/foo",
+		CrateType: "lib",
+		Cfg: []CfgFlag{
+			{Key: "unix"},
+			{Key: "feature", Value: "foo", hasValue: true},
+		},
+		Deps: []Dep{
+			{CrateId: 1, Name: "b_dep"},
+			{CrateId: 2, Name: "a_dep"},
+			{CrateId: 99, Name: "unknown"}, // not in crateByID, must be skipped
+		},
+		CompilerArgs: []string{"-C", "opt-level=3"},
+	}
+
+	got := buildRustcArguments(crate, crateByID)
+	want := []string{
+		"--edition", "2021",
+		"--crate-name", "foo",
+		"--crate-type", "lib",
+		"--cfg", "unix",
+		"--cfg", `feature="foo"`,
+		"-L", "/root/a_dep",
+		"-L", "/root/b_dep",
+		"--extern", "b_dep=/root/b_dep/lib.rs",
+		"--extern", "a_dep=/root/a_dep/lib.rs",
+		"-C", "opt-level=3",
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("buildRustcArguments() = %#v, want %#v", got, want)
+	}
+}
+
+func TestBuildRustcArgumentsOmitsEmptyFields(t *testing.T) {
+	crate := Crate{Label: "src/foo"}
+	got := buildRustcArguments(crate, map[uint32]Crate{})
+	want := []string{"--crate-name", "foo"}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("buildRustcArguments() = %#v, want %#v", got, want)
+	}
+}
+
+func TestBuildRustCompilationDetails(t *testing.T) {
+	crate := Crate{Edition: "2021", CrateId: 7, Target: "x86_64-unknown-linux-gnu"}
+	any, err := buildRustCompilationDetails(crate, []uint32{3, 1, 2})
+	if err != nil {
+		t.Fatalf("buildRustCompilationDetails() = %v, want nil error", err)
+	}
+
+	var details rdpb.RustCompilationDetails
+	if err := any.UnmarshalTo(&details); err != nil {
+		t.Fatalf("UnmarshalTo() = %v, want nil error", err)
+	}
+
+	want := rdpb.RustCompilationDetails{
+		Edition:               "2021",
+		CrateId:               7,
+		Target:                "x86_64-unknown-linux-gnu",
+		TransitiveDepCrateIds: []uint32{1, 2, 3},
+	}
+	if !reflect.DeepEqual(details, want) {
+		t.Errorf("RustCompilationDetails = %+v, want %+v (transitive deps must be sorted)", details, want)
+	}
+}
@@ -0,0 +1,229 @@
+/*
+ * Copyright 2025 The Kythe Authors. All rights reserved.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *   http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package main
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"runtime"
+	"sync"
+
+	"google.golang.org/protobuf/types/known/anypb"
+
+	"kythe.io/kythe/go/platform/kzip"
+	"kythe.io/kythe/go/platform/vfs"
+	apb "kythe.io/kythe/proto/analysis_go_proto"
+)
+
+// addFileRequest asks digestCache's single writer goroutine (see
+// newDigestCache) to add an already-read file's contents to the kzip
+// archive and report back its digest.
+type addFileRequest struct {
+	data io.Reader
+	resp chan<- addFileResult
+}
+
+type addFileResult struct {
+	digest string
+	err    error
+}
+
+// digestCache digests each distinct absolute file path at most once,
+// regardless of how many crates (or goroutines) ask for it. Reading a file
+// off disk happens directly on the calling worker goroutine, so the worker
+// pool's dominant cost -- disk IO -- actually runs concurrently; only the
+// call into writer.AddFile is serialized, by routing it through addFiles,
+// a single dedicated goroutine, the same way buildCompilationUnitsParallel
+// already serializes AddUnit through one consumer goroutine. AddFile calls
+// never overlap one another, but that consumer goroutine is not addFiles, so
+// an AddUnit call can reach kzip.Writer while an AddFile call is still in
+// progress; the writer must accept those two calls concurrently. Two workers racing to digest the
+// same not-yet-cached path can each read it and submit an AddFile request,
+// but that's a rare, harmless duplication of work rather than a
+// correctness issue: kzip.Writer.AddFile dedupes by digest, so the cache
+// still converges on one entry per path.
+type digestCache struct {
+	mu       sync.Mutex
+	writer   *kzip.Writer
+	digests  map[string]string // absolute path -> kzip digest
+	requests chan addFileRequest
+}
+
+func newDigestCache(writer *kzip.Writer) *digestCache {
+	c := &digestCache{writer: writer, digests: make(map[string]string), requests: make(chan addFileRequest)}
+	go c.addFiles()
+	return c
+}
+
+// addFiles serves c.requests one at a time for as long as the workers
+// calling digestFile are still running; close() ends the loop once they're
+// all done.
+func (c *digestCache) addFiles() {
+	for req := range c.requests {
+		digest, err := c.writer.AddFile(req.data)
+		req.resp <- addFileResult{digest: digest, err: err}
+	}
+}
+
+// close shuts down the addFiles goroutine. Callers must not call digestFile
+// after calling close.
+func (c *digestCache) close() {
+	close(c.requests)
+}
+
+// digestFile returns the kzip digest for the file at absPath, adding it to
+// the underlying writer the first time it's seen.
+func (c *digestCache) digestFile(ctx context.Context, absPath string) (string, error) {
+	c.mu.Lock()
+	digest, ok := c.digests[absPath]
+	c.mu.Unlock()
+	if ok {
+		return digest, nil
+	}
+
+	input, err := vfs.Open(ctx, absPath)
+	if err != nil {
+		return "", err
+	}
+	data, err := io.ReadAll(input)
+	input.Close()
+	if err != nil {
+		return "", err
+	}
+
+	resp := make(chan addFileResult, 1)
+	c.requests <- addFileRequest{data: bytes.NewReader(data), resp: resp}
+	result := <-resp
+	if result.err != nil {
+		return "", result.err
+	}
+
+	c.mu.Lock()
+	c.digests[absPath] = result.digest
+	c.mu.Unlock()
+	return result.digest, nil
+}
+
+// crateUnitResult is one crate's fully-built compilation unit, or the error
+// that prevented building it.
+type crateUnitResult struct {
+	crate Crate
+	unit  *apb.CompilationUnit
+	err   error
+}
+
+// buildCompilationUnit resolves crate's sources (via the configured
+// discovery backend), its transitive dependencies' required inputs, and its
+// proc-macro dylib, then assembles the CompilationUnit that resolveCrateSources'
+// sources become. It touches no shared state except cache and mapper, both
+// of which are safe for concurrent use, so it can run on a worker pool.
+func buildCompilationUnit(ctx context.Context, crate Crate, mode DiscoveryMode, cargoMeta *cargoMetadata, projectRoot string, depIncludeDirs []string, depExcludeDirs []string, crateByID map[uint32]Crate, transitiveDeps []uint32, cache *digestCache, mapper *VNameMapper) (*apb.CompilationUnit, error) {
+	var required_inputs = []*apb.CompilationUnit_FileInput{}
+
+	crate_sources, err := resolveCrateSources(ctx, crate, mode, cargoMeta, projectRoot, &required_inputs, cache, mapper)
+	if err != nil {
+		return nil, fmt.Errorf("getting source files for crate %s: %w", crate.Label, err)
+	}
+
+	if _, err := getSourceFiles(ctx, crate, depIncludeDirs, depExcludeDirs, projectRoot, &required_inputs, cache, mapper); err != nil {
+		return nil, fmt.Errorf("getting dependency source files for crate %s: %w", crate.Label, err)
+	}
+
+	if crate.IsProcMacro && crate.ProcMacroDylibPath != "" {
+		input, err := addRequiredInput(ctx, crate.ProcMacroDylibPath, projectRoot, cache, crate, mapper)
+		if err != nil {
+			return nil, fmt.Errorf("adding proc-macro dylib for crate %s: %w", crate.Label, err)
+		}
+		required_inputs = append(required_inputs, input)
+	}
+
+	details, err := buildRustCompilationDetails(crate, transitiveDeps)
+	if err != nil {
+		return nil, fmt.Errorf("building rust compilation details for crate %s: %w", crate.Label, err)
+	}
+
+	return &apb.CompilationUnit{
+		VName:         mapper.MapCrate(crate, projectRoot),
+		Argument:      buildRustcArguments(crate, crateByID),
+		RequiredInput: required_inputs,
+		SourceFile:    crate_sources, // TODO(wittrock): this should probably be the path to the root module and other source files should be in required_inputs.
+		Environment:   crateEnvironment(crate),
+		Details:       []*anypb.Any{details},
+	}, nil
+}
+
+// buildCompilationUnitsParallel builds one compilation unit per crate on a
+// bounded worker pool, then adds each unit to kzip_writer from a single
+// goroutine as they complete (AddUnit, like AddFile, is serialized through
+// the writer). It returns the number of units successfully written.
+func buildCompilationUnitsParallel(ctx context.Context, crates []Crate, mode DiscoveryMode, cargoMeta *cargoMetadata, projectRoot string, source_include_dirs map[uint32][]string, source_exclude_dirs map[uint32][]string, crateByID map[uint32]Crate, transitiveDeps map[uint32][]uint32, kzip_writer *kzip.Writer, mapper *VNameMapper) int {
+	cache := newDigestCache(kzip_writer)
+
+	jobs := make(chan Crate)
+	results := make(chan crateUnitResult)
+
+	concurrency := runtime.NumCPU()
+	if concurrency > len(crates) {
+		concurrency = len(crates)
+	}
+	if concurrency < 1 {
+		concurrency = 1
+	}
+
+	var workers sync.WaitGroup
+	for w := 0; w < concurrency; w++ {
+		workers.Add(1)
+		go func() {
+			defer workers.Done()
+			for crate := range jobs {
+				unit, err := buildCompilationUnit(ctx, crate, mode, cargoMeta, projectRoot, source_include_dirs[crate.CrateId], source_exclude_dirs[crate.CrateId], crateByID, transitiveDeps[crate.CrateId], cache, mapper)
+				results <- crateUnitResult{crate: crate, unit: unit, err: err}
+			}
+		}()
+	}
+
+	go func() {
+		for _, crate := range crates {
+			jobs <- crate
+		}
+		close(jobs)
+	}()
+	go func() {
+		workers.Wait()
+		cache.close()
+		close(results)
+	}()
+
+	written := 0
+	for res := range results {
+		if res.err != nil {
+			fmt.Printf("Error building compilation unit for crate %s: %v\n", res.crate.Label, res.err)
+			continue
+		}
+		digest, err := kzip_writer.AddUnit(res.unit, nil)
+		if err != nil {
+			fmt.Printf("Error adding compilation unit to kzip: %v, crate %s, digest: %s\n", err, res.crate.Label, digest)
+			continue
+		}
+		fmt.Printf("Added crate %s.\n", res.crate.Label)
+		written++
+	}
+
+	return written
+}
@@ -0,0 +1,104 @@
+/*
+ * Copyright 2025 The Kythe Authors. All rights reserved.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *   http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package main
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+
+	"kythe.io/kythe/go/platform/kzip"
+)
+
+// nopWriteCloser adapts a bytes.Buffer to io.WriteCloser, the way vfs.Create
+// would for a real kzip output file.
+type nopWriteCloser struct{ *bytes.Buffer }
+
+func (nopWriteCloser) Close() error { return nil }
+
+func newTestDigestCache(t *testing.T) *digestCache {
+	t.Helper()
+	writer, err := kzip.NewWriteCloser(nopWriteCloser{&bytes.Buffer{}}, kzip.WithEncoding(kzip.EncodingJSON))
+	if err != nil {
+		t.Fatalf("kzip.NewWriteCloser() = %v, want nil error", err)
+	}
+	return newDigestCache(writer)
+}
+
+func TestDigestFileCachesByPath(t *testing.T) {
+	dir := t.TempDir()
+	path := filepath.Join(dir, "lib.rs")
+	if err := os.WriteFile(path, []byte("fn main() {}"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+
+	cache := newTestDigestCache(t)
+	defer cache.close()
+	ctx := context.Background()
+
+	first, err := cache.digestFile(ctx, path)
+	if err != nil {
+		t.Fatalf("digestFile() = %v, want nil error", err)
+	}
+	second, err := cache.digestFile(ctx, path)
+	if err != nil {
+		t.Fatalf("digestFile() = %v, want nil error", err)
+	}
+	if first != second {
+		t.Errorf("digestFile() = %q then %q, want the same digest for the same path", first, second)
+	}
+}
+
+// TestDigestFileConcurrentAccess exercises digestFile from many
+// goroutines at once, the way buildCompilationUnitsParallel's worker pool
+// does. It exists to prove -- under `go test -race` -- that concurrent
+// digestFile calls never reach kzip.Writer.AddFile from more than one
+// goroutine at a time, without relying on an unproven assumption that
+// kzip.Writer itself is safe for concurrent use.
+func TestDigestFileConcurrentAccess(t *testing.T) {
+	dir := t.TempDir()
+	var paths []string
+	for i := 0; i < 20; i++ {
+		path := filepath.Join(dir, fmt.Sprintf("file%d.rs", i))
+		if err := os.WriteFile(path, []byte(fmt.Sprintf("// file %d", i)), 0o644); err != nil {
+			t.Fatal(err)
+		}
+		paths = append(paths, path)
+	}
+
+	cache := newTestDigestCache(t)
+	defer cache.close()
+	ctx := context.Background()
+
+	var wg sync.WaitGroup
+	for w := 0; w < 8; w++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for _, path := range paths {
+				if _, err := cache.digestFile(ctx, path); err != nil {
+					t.Errorf("digestFile(%q) = %v, want nil error", path, err)
+				}
+			}
+		}()
+	}
+	wg.Wait()
+}
@@ -19,14 +19,16 @@ package main
 import (
 	"context"
 	"encoding/json"
+	"flag"
 	"fmt"
 	"os"
 	"path/filepath"
+	"strconv"
+	"strings"
 
 	"kythe.io/kythe/go/platform/kzip"
 	"kythe.io/kythe/go/platform/vfs"
 	apb "kythe.io/kythe/proto/analysis_go_proto"
-	spb "kythe.io/kythe/proto/storage_go_proto"
 )
 
 type Source struct {
@@ -39,32 +41,192 @@ type Dep struct {
 	Name    string `json:"name"`
 }
 
+// CfgFlag is a single `--cfg` entry, which rust-analyzer (and therefore
+// rust-project.json) represents either as a bare atom, e.g. "unix", or as a
+// key/value pair, e.g. `feature="foo"`.
+type CfgFlag struct {
+	Key      string
+	Value    string // empty for atoms; see HasValue.
+	hasValue bool
+}
+
+// HasValue reports whether the flag was written as `key="value"` rather than
+// a bare atom.
+func (c CfgFlag) HasValue() bool { return c.hasValue }
+
+// UnmarshalJSON parses both "KEY" and `KEY="VALUE"` cfg strings.
+func (c *CfgFlag) UnmarshalJSON(data []byte) error {
+	var raw string
+	if err := json.Unmarshal(data, &raw); err != nil {
+		return fmt.Errorf("cfg flag is not a string: %w", err)
+	}
+	if key, value, ok := strings.Cut(raw, "="); ok {
+		if unquoted, err := strconv.Unquote(value); err == nil {
+			value = unquoted
+		}
+		c.Key, c.Value, c.hasValue = key, value, true
+		return nil
+	}
+	c.Key, c.Value, c.hasValue = raw, "", false
+	return nil
+}
+
+func (c CfgFlag) String() string {
+	if c.hasValue {
+		return fmt.Sprintf("%s=%q", c.Key, c.Value)
+	}
+	return c.Key
+}
+
+// BuildInfo mirrors rust-analyzer's `build` crate field, which carries the
+// information needed to re-run a crate's build script.
+type BuildInfo struct {
+	Label      string `json:"label"`
+	OutDir     string `json:"out_dir"`
+	BuildFile  string `json:"build_file"`
+	TargetKind string `json:"target_kind"`
+}
+
 type Crate struct {
-	RootModule   string   `json:"root_module"`
-	Edition      string   `json:"edition"`
-	Deps         []Dep    `json:"deps"`
-	Cfg          []string `json:"cfg"`
+	RootModule   string    `json:"root_module"`
+	Edition      string    `json:"edition"`
+	Deps         []Dep     `json:"deps"`
+	Cfg          []CfgFlag `json:"cfg"`
 	Files        []string
-	CompilerArgs []string `json:"compiler_args"`
-	CrateId      uint32   `json:"crate_id"`
-	Label        string   `json:"label"`
-	Target       string   `json:"target"`
-	Source       Source   `json:"source"`
+	CompilerArgs []string          `json:"compiler_args"`
+	CrateId      uint32            `json:"crate_id"`
+	Label        string            `json:"label"`
+	Target       string            `json:"target"`
+	Source       Source            `json:"source"`
+	DisplayName  string            `json:"display_name"`
+	Version      string            `json:"version"`
+	Env          map[string]string `json:"env"`
+	Repository   string            `json:"repository"`
+	CrateType    string            `json:"crate_type"`
+	Build        *BuildInfo        `json:"build"`
+
+	IsWorkspaceMember  bool   `json:"is_workspace_member"`
+	IsProcMacro        bool   `json:"is_proc_macro"`
+	ProcMacroDylibPath string `json:"proc_macro_dylib_path"`
+
+	// isSysroot marks crates synthesized from RustProject.Sysroot /
+	// SysrootSrc rather than read directly from rust-project.json; see
+	// sysrootCrates.
+	isSysroot bool
 }
 
 type RustProject struct {
-	Crates []Crate `json:"crates"`
+	Crates     []Crate `json:"crates"`
+	Sysroot    string  `json:"sysroot"`
+	SysrootSrc string  `json:"sysroot_src"`
 }
 
+// sysrootLibs are the sysroot crates that a typical rust-analyzer workspace
+// needs resolvable in order to type-check references into the standard
+// library. This mirrors rust-analyzer's own `SYSROOT_CRATES` list.
+var sysrootLibs = []string{"std", "core", "alloc", "proc_macro", "test"}
+
+// sysrootCrates synthesizes Crate entries for the sysroot advertised by a
+// rust-project.json so that references into the standard library resolve to
+// real compilation units instead of dangling. Synthesized crates are
+// appended after every crate found in the file, starting at nextCrateId.
+func sysrootCrates(sysrootSrc string, nextCrateId uint32) []Crate {
+	if sysrootSrc == "" {
+		return nil
+	}
+	var crates []Crate
+	for _, lib := range sysrootLibs {
+		rootModule := filepath.Join(sysrootSrc, "library", lib, "src", "lib.rs")
+		if _, err := os.Stat(rootModule); err != nil {
+			continue
+		}
+		crates = append(crates, Crate{
+			RootModule:        rootModule,
+			Edition:           "2021",
+			CrateId:           nextCrateId,
+			Label:             "//sysroot:" + lib,
+			DisplayName:       lib,
+			IsWorkspaceMember: false,
+			isSysroot:         true,
+			Source: Source{
+				IncludeDirs: []string{filepath.Dir(rootModule)},
+			},
+		})
+		nextCrateId++
+	}
+	return crates
+}
+
+// removeProjectRoot rewrites an absolute path on disk into the
+// forward-slash-separated, VName-canonical path rooted at projectRoot. It
+// resolves symlinks on both sides before comparing so a project root
+// reached through a symlinked mount still strips correctly, and it always
+// returns the result through filepath.ToSlash so VNames are stable across
+// platforms, including Windows where filepath.Walk yields
+// backslash-separated paths. If path and projectRoot differ only in case
+// (e.g. rust-project.json was generated from a differently-cased checkout
+// on a case-insensitive filesystem), the exact comparison falls back to a
+// case-insensitive one -- EvalSymlinks resolves symlinks, not case, so a
+// case mismatch survives it unchanged and would otherwise defeat
+// filepath.Rel's plain string comparison.
 func removeProjectRoot(path string, projectRoot string) string {
-	if len(path) >= len(projectRoot) && path[:len(projectRoot)] == projectRoot {
-		return path[len(projectRoot):]
+	resolvedPath, err := filepath.EvalSymlinks(path)
+	if err != nil {
+		resolvedPath = path
 	}
-	return path
+	resolvedRoot, err := filepath.EvalSymlinks(projectRoot)
+	if err != nil {
+		resolvedRoot = projectRoot
+	}
+
+	if rel, ok := relUnderCaseInsensitive(resolvedRoot, resolvedPath); ok {
+		return filepath.ToSlash(rel)
+	}
+	return filepath.ToSlash(path)
+}
+
+// relUnderCaseInsensitive reports path's path relative to root, trying an
+// exact filepath.Rel first and falling back to a case-insensitive match if
+// that fails or escapes root. The case-insensitive fallback assumes
+// case-folding doesn't change either string's length, which holds for the
+// ASCII paths a case-insensitive-filesystem mismatch actually arises from.
+func relUnderCaseInsensitive(root, path string) (string, bool) {
+	if rel, err := filepath.Rel(root, path); err == nil && !strings.HasPrefix(rel, "..") {
+		return rel, true
+	}
+	lowerRel, err := filepath.Rel(strings.ToLower(root), strings.ToLower(path))
+	if err != nil || strings.HasPrefix(lowerRel, "..") || len(lowerRel) > len(path) {
+		return "", false
+	}
+	return path[len(path)-len(lowerRel):], true
+}
+
+// isExcluded reports whether path falls under excludeDir. Unlike the
+// deprecated filepath.HasPrefix (a plain string-prefix test), this can't be
+// fooled by a sibling directory whose name happens to share excludeDir as a
+// string prefix, e.g. excluding "/a/b" must not also exclude "/a/bar/...".
+func isExcluded(path string, excludeDir string) bool {
+	rel, err := filepath.Rel(excludeDir, path)
+	if err != nil {
+		return false
+	}
+	return rel == "." || !strings.HasPrefix(rel, "..")
 }
 
 // todo:refactor
-func getSourceFiles(ctx context.Context, crate Crate, include_dirs []string, exclude_dirs []string, projectRoot string, required_inputs *[]*apb.CompilationUnit_FileInput, kzip_writer *kzip.Writer) ([]string, error) {
+//
+// getSourceFiles appends to required_inputs rather than replacing it, so
+// callers can invoke it more than once per compilation unit (e.g. once for
+// a crate's own sources, once for its transitive deps') without losing
+// earlier results. Digesting is delegated to cache, which both dedupes the
+// IO for a file shared by many crates and makes this safe to call from
+// multiple goroutines concurrently targeting the same kzip writer.
+func getSourceFiles(ctx context.Context, crate Crate, include_dirs []string, exclude_dirs []string, projectRoot string, required_inputs *[]*apb.CompilationUnit_FileInput, cache *digestCache, mapper *VNameMapper) ([]string, error) {
+	seen := make(map[string]bool)
+	for _, input := range *required_inputs {
+		seen[input.Info.Path] = true
+	}
+
 	var source_files []string
 	for _, include_dir := range include_dirs {
 
@@ -77,7 +239,7 @@ func getSourceFiles(ctx context.Context, crate Crate, include_dirs []string, exc
 			}
 
 			for _, exclude_dir := range exclude_dirs {
-				if filepath.HasPrefix(path, exclude_dir) {
+				if isExcluded(path, exclude_dir) {
 					return nil
 				}
 			}
@@ -87,29 +249,24 @@ func getSourceFiles(ctx context.Context, crate Crate, include_dirs []string, exc
 				return nil
 			}
 
-			input, err := vfs.Open(ctx, path)
-			if err != nil {
-				return err
+			relPath := removeProjectRoot(path, projectRoot)
+			if seen[relPath] {
+				return nil
 			}
-			defer input.Close()
+			seen[relPath] = true
 
-			digest, err := kzip_writer.AddFile(input)
+			digest, err := cache.digestFile(ctx, path)
 			if err != nil {
 				return err
 			}
 
-			path = removeProjectRoot(path, projectRoot)
-			vname := &spb.VName{
-				Corpus:   "fuchsia",
-				Language: "rust",
-				Path:     path,
-			}
+			vname := mapper.Map(relPath, crate)
 
-			source_files = append(source_files, path)
+			source_files = append(source_files, relPath)
 			*required_inputs = append(*required_inputs, &apb.CompilationUnit_FileInput{
 				VName: vname,
 				Info: &apb.FileInfo{
-					Path:   path,
+					Path:   relPath,
 					Digest: digest,
 				},
 			})
@@ -124,6 +281,62 @@ func getSourceFiles(ctx context.Context, crate Crate, include_dirs []string, exc
 	return source_files, nil
 }
 
+// resolveCrateSources finds crate's source files using the configured
+// discovery backend. DiscoveryRustProject always walks
+// crate.Source.IncludeDirs/ExcludeDirs; DiscoveryCargoMetadata always
+// defers to cargo-metadata; DiscoveryHybrid prefers cargo-metadata but
+// falls back to the include dirs for crates cargo metadata can't find
+// (e.g. sysroot crates, which have no Cargo.toml).
+func resolveCrateSources(ctx context.Context, crate Crate, mode DiscoveryMode, cargoMeta *cargoMetadata, projectRoot string, required_inputs *[]*apb.CompilationUnit_FileInput, cache *digestCache, mapper *VNameMapper) ([]string, error) {
+	if mode == DiscoveryCargoMetadata || mode == DiscoveryHybrid {
+		sources, ok, err := getSourceFilesFromCargoMetadata(ctx, crate, cargoMeta, projectRoot, required_inputs, cache, mapper)
+		if err != nil {
+			return nil, err
+		}
+		if ok {
+			return sources, nil
+		}
+		if mode == DiscoveryCargoMetadata {
+			return nil, fmt.Errorf("no cargo-metadata package found for crate %s", crate.Label)
+		}
+		// hybrid: fall through to the rust-project.json include dirs.
+	}
+	return getSourceFiles(ctx, crate, crate.Source.IncludeDirs, crate.Source.ExcludeDirs, projectRoot, required_inputs, cache, mapper)
+}
+
+// addRequiredInput digests a single file (e.g. a proc-macro dylib or a
+// sysroot source not reachable by the normal directory walk) and returns the
+// FileInput that should be attached to a compilation unit's RequiredInput.
+func addRequiredInput(ctx context.Context, path string, projectRoot string, cache *digestCache, crate Crate, mapper *VNameMapper) (*apb.CompilationUnit_FileInput, error) {
+	digest, err := cache.digestFile(ctx, path)
+	if err != nil {
+		return nil, err
+	}
+
+	relPath := removeProjectRoot(path, projectRoot)
+	return &apb.CompilationUnit_FileInput{
+		VName: mapper.Map(relPath, crate),
+		Info: &apb.FileInfo{
+			Path:   relPath,
+			Digest: digest,
+		},
+	}, nil
+}
+
+// crateEnvironment converts a crate's `env` map (and any build-script
+// OUT_DIR it reports) into the Environment entries rustc would have seen
+// when the crate was actually compiled.
+func crateEnvironment(crate Crate) []*apb.CompilationUnit_Env {
+	var env []*apb.CompilationUnit_Env
+	for name, value := range crate.Env {
+		env = append(env, &apb.CompilationUnit_Env{Name: name, Value: value})
+	}
+	if crate.Build != nil && crate.Build.OutDir != "" {
+		env = append(env, &apb.CompilationUnit_Env{Name: "OUT_DIR", Value: crate.Build.OutDir})
+	}
+	return env
+}
+
 func getSourceDirs(crates []Crate, transitiveDeps map[uint32][]uint32) (map[uint32][]string, map[uint32][]string) {
 	source_include_dirs := make(map[uint32][]string)
 	source_exclude_dirs := make(map[uint32][]string)
@@ -176,16 +389,38 @@ func getTransitiveDependencies(crate Crate, crate_deps map[uint32][]uint32) []ui
 }
 
 func main() {
-	if len(os.Args) < 4 {
-		fmt.Println("Usage: go run main.go <project_json_path> <output_dir> <project_root>")
+	vnamesPath := flag.String("vnames", "", "path to a JSON vnames config mapping path/crate patterns to {corpus, root, path} rewrites; see VNameMapper")
+	discovery := flag.String("discovery", string(DiscoveryRustProject), "how to find each crate's source files: rust-project, cargo-metadata, or hybrid")
+	workspaceDir := flag.String("workspace", "", "directory containing the Cargo.toml workspace, required for --discovery=cargo-metadata or hybrid")
+	flag.Parse()
+
+	args := flag.Args()
+	if len(args) < 3 {
+		fmt.Println("Usage: rust_project_to_kzip [--vnames=path] [--discovery=mode] [--workspace=dir] <project_json_path> <output_dir> <project_root>")
 		os.Exit(1)
 	}
 
 	ctx := context.Background()
 
-	projectJSONPath := os.Args[1]
-	outputDir := os.Args[2]
-	projectRoot := os.Args[3]
+	projectJSONPath := args[0]
+	outputDir := args[1]
+	projectRoot := args[2]
+	discoveryMode := DiscoveryMode(*discovery)
+
+	mapper, err := LoadVNameMapper(*vnamesPath)
+	if err != nil {
+		fmt.Printf("Error loading vnames config: %v\n", err)
+		os.Exit(1)
+	}
+
+	var cargoMeta *cargoMetadata
+	if discoveryMode == DiscoveryCargoMetadata || discoveryMode == DiscoveryHybrid {
+		cargoMeta, err = loadCargoMetadata(ctx, *workspaceDir)
+		if err != nil {
+			fmt.Printf("Error loading cargo metadata: %v\n", err)
+			os.Exit(1)
+		}
+	}
 
 	if projectRoot[len(projectRoot)-1] != '/' {
 		projectRoot += "/"
@@ -222,6 +457,17 @@ func main() {
 
 	crates := projectJSON.Crates
 
+	var maxCrateId uint32
+	for _, crate := range crates {
+		if crate.CrateId > maxCrateId {
+			maxCrateId = crate.CrateId
+		}
+	}
+	if synthetic := sysrootCrates(projectJSON.SysrootSrc, maxCrateId+1); len(synthetic) > 0 {
+		fmt.Printf("synthesized %d sysroot crates from %s\n", len(synthetic), projectJSON.SysrootSrc)
+		crates = append(crates, synthetic...)
+	}
+
 	firstCrate, err := json.MarshalIndent(crates[0], "", "    ")
 	if err != nil {
 		fmt.Printf("Error marshalling first crate: %v\n", err)
@@ -233,7 +479,9 @@ func main() {
 	_ = os.RemoveAll(outputDir)
 
 	crate_deps := make(map[uint32][]uint32)
+	crateByID := make(map[uint32]Crate, len(crates))
 	for _, crate := range crates {
+		crateByID[crate.CrateId] = crate
 		for _, dep := range crate.Deps {
 			crate_deps[crate.CrateId] = append(crate_deps[crate.CrateId], dep.CrateId)
 		}
@@ -264,46 +512,7 @@ func main() {
 		os.Exit(1)
 	}
 
-	i := 0
-	for _, crate := range crates {
-		var crate_sources []string
-		var required_inputs = []*apb.CompilationUnit_FileInput{}
-
-		fmt.Printf("Adding crate %s...", crate.Label)
-
-		if crate_sources, err = getSourceFiles(ctx, crate, crate.Source.IncludeDirs, crate.Source.ExcludeDirs, projectRoot, &required_inputs, kzip_writer); err != nil {
-			fmt.Printf("Error getting source files for crate %s: %v\n", crate.Label, err)
-			continue
-		}
-
-		// todo: wtf is this function call
-		required_inputs = []*apb.CompilationUnit_FileInput{}
-		if _, err := getSourceFiles(ctx, crate, source_include_dirs[crate.CrateId], source_exclude_dirs[crate.CrateId], projectRoot, &required_inputs, kzip_writer); err != nil {
-			fmt.Printf("Error getting source files for crate %s: %v\n", crate.Label, err)
-			continue
-		}
-
-		compilation_unit := &apb.CompilationUnit{
-			VName: &spb.VName{
-				Corpus:   "fuchsia",
-				Language: "rust",
-				Root:     crate.Label,
-			},
-			RequiredInput: required_inputs,
-			SourceFile:    crate_sources, // TODO(wittrock): this should probably be the path to the root module and other source files should be in required_inputs.
-		}
-
-		digest, err := kzip_writer.AddUnit(compilation_unit, nil)
-		if err != nil {
-			fmt.Printf("Error adding compilation unit to kzip: %v, crate %s, digest: %s\n", err, crate.Label, digest)
-			fmt.Printf("required inputs for crate %s on platform %s: %v\n", crate.Label, crate.Target, required_inputs)
-			fmt.Printf("source include dirs for crate %s: %v", crate.Label, source_include_dirs[crate.CrateId])
-			continue
-		}
-
-		fmt.Println(" done.")
-		i++
-	}
+	i := buildCompilationUnitsParallel(ctx, crates, discoveryMode, cargoMeta, projectRoot, source_include_dirs, source_exclude_dirs, crateByID, transitiveDeps, kzip_writer, mapper)
 
 	fmt.Printf("Added %d crates\n", len(crates))
 	fmt.Printf("Wrote %d units\n", i)
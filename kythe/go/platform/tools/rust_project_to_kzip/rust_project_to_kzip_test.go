@@ -0,0 +1,85 @@
+/*
+ * Copyright 2025 The Kythe Authors. All rights reserved.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *   http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestRemoveProjectRoot(t *testing.T) {
+	root := t.TempDir()
+	sub := filepath.Join(root, "src")
+	if err := os.MkdirAll(sub, 0o755); err != nil {
+		t.Fatal(err)
+	}
+	path := filepath.Join(sub, "lib.rs")
+
+	if got, want := removeProjectRoot(path, root), "src/lib.rs"; got != want {
+		t.Errorf("removeProjectRoot(%q, %q) = %q, want %q", path, root, got, want)
+	}
+}
+
+func TestRemoveProjectRootOutsideRootReturnsOriginal(t *testing.T) {
+	root := t.TempDir()
+	other := t.TempDir()
+	path := filepath.Join(other, "lib.rs")
+
+	if got := removeProjectRoot(path, root); got != filepath.ToSlash(path) {
+		t.Errorf("removeProjectRoot(%q, %q) = %q, want original path %q", path, root, got, filepath.ToSlash(path))
+	}
+}
+
+func TestRemoveProjectRootCaseInsensitiveFallback(t *testing.T) {
+	base := t.TempDir()
+	root := filepath.Join(base, "ProjectRoot")
+	if err := os.MkdirAll(filepath.Join(root, "Src"), 0o755); err != nil {
+		t.Fatal(err)
+	}
+	path := filepath.Join(root, "Src", "lib.rs")
+
+	// A differently-cased root, as if rust-project.json recorded a checkout
+	// path whose case doesn't match the one actually on disk.
+	mismatchedRoot := filepath.Join(base, "projectroot")
+
+	got := removeProjectRoot(path, mismatchedRoot)
+	if want := "Src/lib.rs"; got != want {
+		t.Errorf("removeProjectRoot(%q, %q) = %q, want %q", path, mismatchedRoot, got, want)
+	}
+}
+
+func TestIsExcluded(t *testing.T) {
+	tests := []struct {
+		name       string
+		path       string
+		excludeDir string
+		want       bool
+	}{
+		{name: "file under excluded dir", path: "/a/b/c.rs", excludeDir: "/a/b", want: true},
+		{name: "excluded dir itself", path: "/a/b", excludeDir: "/a/b", want: true},
+		{name: "sibling sharing prefix", path: "/a/bar/c.rs", excludeDir: "/a/b", want: false},
+		{name: "unrelated path", path: "/x/y.rs", excludeDir: "/a/b", want: false},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			if got := isExcluded(test.path, test.excludeDir); got != test.want {
+				t.Errorf("isExcluded(%q, %q) = %v, want %v", test.path, test.excludeDir, got, test.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,145 @@
+/*
+ * Copyright 2025 The Kythe Authors. All rights reserved.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *   http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"regexp"
+
+	spb "kythe.io/kythe/proto/storage_go_proto"
+)
+
+// defaultCorpus is the VName corpus used when no rule in a VNameMapper
+// matches, preserving this tool's original Fuchsia-only behavior.
+const defaultCorpus = "fuchsia"
+
+// VNameRule rewrites the path of a file (or the Root of a crate's
+// compilation unit) into a VName. Rules are evaluated first-match-wins, in
+// the order they appear in the config file, mirroring Kythe's vnames.json.
+//
+// Pattern is anchored at compile time (wrapped as "^(?:" + Pattern + ")$")
+// so it must match the entire path, the way Kythe's vnameutil anchors
+// vnames.json patterns -- a pattern meant to match a specific path
+// component can't accidentally match a sibling path that merely contains
+// it as a substring. Corpus, Root and Path may reference capture groups from
+// Pattern using Go's regexp.Expand syntax, e.g. "crates.io/${crate}@${version}".
+//
+// IsWorkspaceMember and Sysroot, when set, further restrict a rule to only
+// apply to crates whose corresponding Crate field matches; a rule that
+// omits them applies regardless of crate kind.
+type VNameRule struct {
+	Pattern           string `json:"pattern"`
+	IsWorkspaceMember *bool  `json:"is_workspace_member,omitempty"`
+	Sysroot           *bool  `json:"sysroot,omitempty"`
+	Corpus            string `json:"corpus"`
+	Root              string `json:"root"`
+	Path              string `json:"path"`
+
+	re *regexp.Regexp
+}
+
+// VNameMapper is the parsed form of a rust_project_to_kzip vnames config:
+// an ordered list of rewrite rules consulted for every file and crate this
+// tool emits.
+type VNameMapper struct {
+	Rules []*VNameRule `json:"rules"`
+}
+
+// LoadVNameMapper reads and compiles a vnames config file. A missing path
+// returns an empty mapper so callers can treat "no --vnames flag" and "empty
+// rule list" identically.
+func LoadVNameMapper(path string) (*VNameMapper, error) {
+	if path == "" {
+		return &VNameMapper{}, nil
+	}
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("reading vnames config %q: %w", path, err)
+	}
+	var mapper VNameMapper
+	if err := json.Unmarshal(data, &mapper); err != nil {
+		return nil, fmt.Errorf("parsing vnames config %q: %w", path, err)
+	}
+	for _, rule := range mapper.Rules {
+		re, err := regexp.Compile("^(?:" + rule.Pattern + ")$")
+		if err != nil {
+			return nil, fmt.Errorf("vnames config %q: bad pattern %q: %w", path, rule.Pattern, err)
+		}
+		rule.re = re
+	}
+	return &mapper, nil
+}
+
+// matchesCrate reports whether rule's crate-kind filters (if any) admit crate.
+func (rule *VNameRule) matchesCrate(crate Crate) bool {
+	if rule.IsWorkspaceMember != nil && *rule.IsWorkspaceMember != crate.IsWorkspaceMember {
+		return false
+	}
+	if rule.Sysroot != nil && *rule.Sysroot != crate.isSysroot {
+		return false
+	}
+	return true
+}
+
+// Map rewrites path into a VName for the given crate, consulting rules in
+// order and returning the first match. If no rule matches, it falls back to
+// this tool's historical behavior: corpus "fuchsia", language "rust", and
+// the path unchanged.
+func (m *VNameMapper) Map(path string, crate Crate) *spb.VName {
+	for _, rule := range m.Rules {
+		if !rule.matchesCrate(crate) {
+			continue
+		}
+		loc := rule.re.FindStringSubmatchIndex(path)
+		if loc == nil {
+			continue
+		}
+		vname := &spb.VName{
+			Corpus:   string(rule.re.ExpandString(nil, rule.Corpus, path, loc)),
+			Root:     string(rule.re.ExpandString(nil, rule.Root, path, loc)),
+			Path:     path,
+			Language: "rust",
+		}
+		if rule.Path != "" {
+			vname.Path = string(rule.re.ExpandString(nil, rule.Path, path, loc))
+		}
+		return vname
+	}
+	return &spb.VName{Corpus: defaultCorpus, Language: "rust", Path: path}
+}
+
+// MapCrate returns the VName for a crate's compilation unit. Rules match
+// against the crate's root module path relative to projectRoot (crates are
+// more naturally addressed by where they live than by their
+// rust-project.json label), the same project-root-relative path space
+// every file-level VName is matched against via removeProjectRoot -- a
+// rule anchored against a relative path (e.g. a vendored-crate pattern like
+// "third_party/rust_crates/vendor/...") must match here exactly as it does for
+// that crate's files, not fall through to defaultCorpus because it was
+// compared against an absolute path instead. A matching rule's Root
+// template is optional: when empty, the crate's original Label is kept as
+// the Root, preserving this tool's original per-crate Root behavior.
+func (m *VNameMapper) MapCrate(crate Crate, projectRoot string) *spb.VName {
+	vname := m.Map(removeProjectRoot(crate.RootModule, projectRoot), crate)
+	vname.Path = ""
+	if vname.Root == "" {
+		vname.Root = crate.Label
+	}
+	return vname
+}
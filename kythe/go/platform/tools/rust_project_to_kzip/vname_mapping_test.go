@@ -0,0 +1,144 @@
+/*
+ * Copyright 2025 The Kythe Authors. All rights reserved.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *   http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package main
+
+import (
+	"regexp"
+	"testing"
+
+	spb "kythe.io/kythe/proto/storage_go_proto"
+)
+
+func mustCompileRule(t *testing.T, rule *VNameRule) *VNameRule {
+	t.Helper()
+	re, err := regexp.Compile("^(?:" + rule.Pattern + ")$")
+	if err != nil {
+		t.Fatalf("regexp.Compile(%q) = %v", rule.Pattern, err)
+	}
+	rule.re = re
+	return rule
+}
+
+func TestVNameMapperMapAnchorsPatterns(t *testing.T) {
+	mapper := &VNameMapper{Rules: []*VNameRule{
+		mustCompileRule(t, &VNameRule{
+			Pattern: `registry/src/[^/]+/serde-[0-9.]+/.*`,
+			Corpus:  "crates.io",
+		}),
+	}}
+
+	// An unanchored search would find the rule's pattern starting at
+	// "registry/"; the full path, with its leading "vendor/", must not match.
+	path := "vendor/registry/src/x/serde-1.0/lib.rs"
+	vname := mapper.Map(path, Crate{})
+	if vname.Corpus != defaultCorpus {
+		t.Errorf("Map(%q) matched an unanchored substring: got corpus %q, want fallback %q", path, vname.Corpus, defaultCorpus)
+	}
+}
+
+func TestVNameMapperMapFirstMatchWins(t *testing.T) {
+	mapper := &VNameMapper{Rules: []*VNameRule{
+		mustCompileRule(t, &VNameRule{Pattern: `registry/src/.*`, Corpus: "first"}),
+		mustCompileRule(t, &VNameRule{Pattern: `registry/src/.*`, Corpus: "second"}),
+	}}
+
+	vname := mapper.Map("registry/src/serde-1.2.3/lib.rs", Crate{})
+	if vname.Corpus != "first" {
+		t.Errorf("Map() = corpus %q, want %q (first matching rule)", vname.Corpus, "first")
+	}
+}
+
+func TestVNameMapperMapExpandsCaptureGroups(t *testing.T) {
+	mapper := &VNameMapper{Rules: []*VNameRule{
+		mustCompileRule(t, &VNameRule{
+			Pattern: `registry/src/[^/]+/(?P<crate>[^/]+)-(?P<version>[0-9.]+)/.*`,
+			Corpus:  "crates.io",
+			Root:    "${crate}@${version}",
+		}),
+	}}
+
+	vname := mapper.Map("registry/src/index.crates.io/serde-1.2.3/lib.rs", Crate{})
+	if vname.Root != "serde@1.2.3" {
+		t.Errorf("Map() = root %q, want %q", vname.Root, "serde@1.2.3")
+	}
+}
+
+func TestVNameMapperMapFiltersByCrateKind(t *testing.T) {
+	isWorkspaceMember := true
+	mapper := &VNameMapper{Rules: []*VNameRule{
+		mustCompileRule(t, &VNameRule{
+			Pattern:           `.*`,
+			IsWorkspaceMember: &isWorkspaceMember,
+			Corpus:            "workspace",
+		}),
+	}}
+
+	vname := mapper.Map("src/lib.rs", Crate{IsWorkspaceMember: false})
+	if vname.Corpus != defaultCorpus {
+		t.Errorf("Map() on a non-workspace-member crate = corpus %q, want fallback %q", vname.Corpus, defaultCorpus)
+	}
+
+	vname = mapper.Map("src/lib.rs", Crate{IsWorkspaceMember: true})
+	if vname.Corpus != "workspace" {
+		t.Errorf("Map() on a workspace-member crate = corpus %q, want %q", vname.Corpus, "workspace")
+	}
+}
+
+func TestVNameMapperMapNoRulesFallsBackToDefault(t *testing.T) {
+	mapper := &VNameMapper{}
+	vname := mapper.Map("src/lib.rs", Crate{})
+	want := &spb.VName{Corpus: defaultCorpus, Language: "rust", Path: "src/lib.rs"}
+	if vname.Corpus != want.Corpus || vname.Language != want.Language || vname.Path != want.Path {
+		t.Errorf("Map() = %+v, want %+v", vname, want)
+	}
+}
+
+func TestVNameMapperMapCrateUsesProjectRootRelativePath(t *testing.T) {
+	// A rule anchored against a project-root-relative vendored path must
+	// match a crate's
+	// RootModule the same way it matches that crate's files -- not fall
+	// through to defaultCorpus because MapCrate compared it against an
+	// absolute path instead.
+	mapper := &VNameMapper{Rules: []*VNameRule{
+		mustCompileRule(t, &VNameRule{
+			Pattern: `third_party/rust_crates/vendor/(?P<crate>[^/]+)-(?P<version>[0-9.]+)/.*`,
+			Corpus:  "crates.io",
+			Root:    "${crate}@${version}",
+		}),
+	}}
+
+	crate := Crate{
+		Label:      "//third_party/rust_crates:serde-1.2.3",
+		RootModule: "/workspace/third_party/rust_crates/vendor/serde-1.2.3/src/lib.rs",
+	}
+	vname := mapper.MapCrate(crate, "/workspace")
+	if vname.Corpus != "crates.io" || vname.Root != "serde@1.2.3" {
+		t.Errorf("MapCrate() = %+v, want Corpus %q and Root %q", vname, "crates.io", "serde@1.2.3")
+	}
+	if vname.Path != "" {
+		t.Errorf("MapCrate() = %+v, want empty Path", vname)
+	}
+}
+
+func TestVNameMapperMapCrateFallsBackToLabelForRoot(t *testing.T) {
+	mapper := &VNameMapper{}
+	crate := Crate{Label: "//src:foo", RootModule: "/workspace/src/lib.rs"}
+	vname := mapper.MapCrate(crate, "/workspace")
+	if vname.Root != crate.Label {
+		t.Errorf("MapCrate() = %+v, want Root %q (the crate's Label)", vname, crate.Label)
+	}
+}